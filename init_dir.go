@@ -25,18 +25,35 @@ func initDir(args *argContainer) {
 			os.Exit(ERREXIT_INIT)
 		}
 	}
-	// Choose password for config file
-	if args.extpass == "" {
-		tlog.Info.Printf("Choose a password for protecting your files.")
-	} else {
-		tlog.Info.Printf("Using password provided via -extpass.")
-	}
-	password := readpassword.Twice(args.extpass)
 	creator := tlog.ProgramName + " " + GitVersion
-	err = configfile.CreateConfFile(args.config, password, args.plaintextnames, args.scryptn, creator)
-	if err != nil {
-		tlog.Fatal.Println(err)
-		os.Exit(ERREXIT_INIT)
+	if args.pkcs11Module != "" {
+		// The masterkey is wrapped by a key object on the PKCS#11 token
+		// instead of a password, so there is nothing to read from the
+		// terminal and no KEK ever exists outside the token.
+		tlog.Info.Printf("Using PKCS#11 token %q, slot %d, label %q.",
+			args.pkcs11Module, args.pkcs11Slot, args.pkcs11Label)
+		err = configfile.CreateConfFileWithPKCS11(args.config, args.plaintextnames,
+			args.pkcs11Module, args.pkcs11Slot, args.pkcs11Label, creator)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(ERREXIT_INIT)
+		}
+	} else {
+		// Choose password for config file. The key-wrapping key is derived
+		// from it using args.kdf ("scrypt" or "argon2id"); args.scryptn and
+		// args.argon2Params hold the tuning parameters for whichever one was
+		// picked, either from -scryptn/-kdf-benchmark or their defaults.
+		if args.extpass == "" {
+			tlog.Info.Printf("Choose a password for protecting your files.")
+		} else {
+			tlog.Info.Printf("Using password provided via -extpass.")
+		}
+		password := readpassword.Twice(args.extpass)
+		err = configfile.CreateConfFile(args.config, password, args.plaintextnames, args.kdf, args.scryptn, args.argon2Params, creator)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(ERREXIT_INIT)
+		}
 	}
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv
 	// in the root dir
@@ -0,0 +1,89 @@
+package integration_tests
+
+// Verify that the FilePathAAD feature flag (path bound into each file's
+// AEAD header) detects ciphertext files being swapped on disk. Legacy
+// volumes without the flag are not exercised here.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ciphertextFileWrittenAfter returns the cipherdir-relative regular file
+// with the newest modification time, as long as it is newer than "since".
+// Tests use it right after writing one plaintext file through the mount
+// to find that file's ciphertext counterpart, since this test package has
+// no name-decryption helper to map a plaintext path to its ciphertext
+// path directly.
+func ciphertextFileWrittenAfter(since time.Time) (string, error) {
+	var newest string
+	var newestTime time.Time
+	err := filepath.Walk(defaultCipherDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if fi.ModTime().After(since) && fi.ModTime().After(newestTime) {
+			newest = path
+			newestTime = fi.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if newest == "" {
+		return "", os.ErrNotExist
+	}
+	return newest, nil
+}
+
+// TestSwapDetection creates two files, swaps their ciphertext on disk
+// (bypassing gocryptfs) and checks that reading either one back through
+// the mount now fails with an authentication error instead of silently
+// returning the other file's content.
+func TestSwapDetection(t *testing.T) {
+	if plaintextNames {
+		t.Skip("path-id binding needs encrypted names to find the ciphertext files")
+	}
+
+	p1 := defaultPlainDir + "swapA"
+	t1 := time.Now()
+	if err := ioutil.WriteFile(p1, []byte("contentA"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c1, err := ciphertextFileWrittenAfter(t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := defaultPlainDir + "swapB"
+	t2 := time.Now()
+	if err := ioutil.WriteFile(p2, []byte("contentB"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := ciphertextFileWrittenAfter(t2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the ciphertext files directly, without going through the mount.
+	if err := os.Rename(c1, c1+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(c2, c1); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(c1+".tmp", c2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadFile(p1); err == nil {
+		t.Errorf("reading a swapped file should fail with an auth error, but succeeded")
+	}
+	if _, err := ioutil.ReadFile(p2); err == nil {
+		t.Errorf("reading a swapped file should fail with an auth error, but succeeded")
+	}
+}
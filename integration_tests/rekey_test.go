@@ -0,0 +1,100 @@
+package integration_tests
+
+// Rekey: a second rekey (or a concurrent mount, via
+// checkRekeyNotInProgress - see mount_test.go) must be refused while one
+// is already running, because the flock on gocryptfs.rekey.journal.lock
+// is exclusive and non-blocking. TestRekeySucceedsWithContent exercises
+// the actual decrypt/re-encrypt path on a real file, which the lock test
+// below does not.
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRekeyRefusesConcurrentRekey creates its own password-protected
+// volume (the default test fixture is mounted with --zerokey and has no
+// gocryptfs.conf for -rekey to read), starts a rekey in the background,
+// and verifies that a second rekey on the same cipherdir is refused while
+// the first one holds the lock.
+func TestRekeyRefusesConcurrentRekey(t *testing.T) {
+	cipherdir, err := ioutil.TempDir(tmpDir, "rekey-lock-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+
+	initCmd := exec.Command(gocryptfsBinary, "-init", "-extpass", "echo test", cipherdir)
+	if out, err := initCmd.CombinedOutput(); err != nil {
+		t.Fatalf("init failed: %v: %s", err, out)
+	}
+
+	first := exec.Command(gocryptfsBinary, "-rekey", "-extpass", "echo test", cipherdir)
+	if err := first.Start(); err != nil {
+		t.Fatalf("failed to start first rekey: %v", err)
+	}
+	defer first.Wait()
+	// Give the first rekey a moment to take the lock before the second
+	// one races it.
+	time.Sleep(100 * time.Millisecond)
+
+	second := exec.Command(gocryptfsBinary, "-rekey", "-extpass", "echo test", cipherdir)
+	out, err := second.CombinedOutput()
+	if err == nil {
+		t.Errorf("a second concurrent rekey should have been refused, but it succeeded")
+	} else if !strings.Contains(string(out), "rekey") {
+		t.Errorf("second rekey failed for an unexpected reason: %s", out)
+	}
+}
+
+// TestRekeySucceedsWithContent mounts a password-protected volume, writes
+// a file through it, rekeys the (unmounted) cipherdir to completion, and
+// remounts to check the content survived. Unlike
+// TestRekeyRefusesConcurrentRekey, this actually drives rekeyFile's
+// decrypt/re-encrypt path on a real file, so it catches decrypt-side AAD
+// mistakes that a lock-only test would miss.
+func TestRekeySucceedsWithContent(t *testing.T) {
+	cipherdir, err := ioutil.TempDir(tmpDir, "rekey-content-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+	plaindir, err := ioutil.TempDir(tmpDir, "rekey-content-test-plain-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(plaindir)
+
+	initCmd := exec.Command(gocryptfsBinary, "-init", "-extpass", "echo test", cipherdir)
+	if out, err := initCmd.CombinedOutput(); err != nil {
+		t.Fatalf("init failed: %v: %s", err, out)
+	}
+
+	mount(cipherdir, plaindir, "-extpass", "echo test")
+	want := []byte("rekey me please")
+	if err := ioutil.WriteFile(plaindir+"/secret.txt", want, 0600); err != nil {
+		unmount(plaindir)
+		t.Fatal(err)
+	}
+	unmount(plaindir)
+
+	rekeyCmd := exec.Command(gocryptfsBinary, "-rekey", "-extpass", "echo test", cipherdir)
+	if out, err := rekeyCmd.CombinedOutput(); err != nil {
+		t.Fatalf("rekey failed: %v: %s", err, out)
+	}
+
+	mount(cipherdir, plaindir, "-extpass", "echo test")
+	defer unmount(plaindir)
+	got, err := ioutil.ReadFile(plaindir + "/secret.txt")
+	if err != nil {
+		t.Fatalf("could not read back secret.txt after rekey: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("content changed across rekey: got %q, want %q", got, want)
+	}
+}
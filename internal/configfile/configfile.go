@@ -0,0 +1,205 @@
+// Package configfile reads and writes gocryptfs.conf.
+package configfile
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// ConfDefaultName is the default configuration file name.
+	ConfDefaultName = "gocryptfs.conf"
+
+	// scryptSaltLen is the length of the scrypt salt, in bytes.
+	scryptSaltLen = 32
+)
+
+// ScryptParams stores the scrypt parameters used to derive the key-wrapping
+// key from the user's password. This is the on-disk format used by
+// config file versions before the KDF field was introduced, and is kept
+// around (and populated with the legacy defaults) so those files keep
+// loading unchanged.
+type ScryptParams struct {
+	Salt []byte
+	N    int
+	R    int
+	P    int
+}
+
+// ConfFile is the content of gocryptfs.conf.
+type ConfFile struct {
+	// Creator is the gocryptfs version string that created the file.
+	Creator string
+	// EncryptedKey is the AES-256 masterkey, encrypted with the key derived
+	// from the user's password by the configured KDF.
+	EncryptedKey []byte
+	// ScryptObject holds the scrypt parameters when KDF is unset (legacy
+	// config files) or when KDF.Algo == kdfScrypt.
+	ScryptObject ScryptParams
+	// KDF holds the key derivation function parameters for config files
+	// written by a gocryptfs that knows about algorithms beyond scrypt.
+	// It is omitted entirely for files written by older versions, which
+	// are assumed to use scrypt with the parameters in ScryptObject.
+	KDF *KDFConf `json:",omitempty"`
+	// PKCS11 holds the token identifiers and wrapped masterkey for volumes
+	// created with -pkcs11-module. It is mutually exclusive with KDF: when
+	// it is set, EncryptedKey and ScryptObject are left at their zero
+	// values and unwrapping goes through the token instead of a password.
+	PKCS11 *PKCS11Conf `json:",omitempty"`
+	// Version is the on-disk format version, currently 2.
+	Version uint16
+	// FeatureFlags is a list of feature flag names. See knownFlags in
+	// known_flags.go for the flags this version understands.
+	FeatureFlags []string
+
+	filename string
+}
+
+// CreateConfFile creates a new gocryptfs.conf with a random masterkey,
+// encrypted with a key wrapping key derived from "password" using "kdf".
+//
+// kdf selects the key derivation function ("scrypt" or "argon2id"). For
+// "scrypt", logN is the scrypt work factor (as produced by -scryptn /
+// ScryptKDFBenchmark). For "argon2id", argon2Params must be non-nil and is
+// used as-is (as produced by Argon2idKDFBenchmark).
+func CreateConfFile(filename string, password []byte, plaintextNames bool, kdf string, logN int, argon2Params *Argon2Params, creator string) error {
+	cf := ConfFile{
+		Creator:  creator,
+		Version:  2,
+		filename: filename,
+	}
+	if plaintextNames {
+		cf.FeatureFlags = append(cf.FeatureFlags, "PlaintextNames")
+	}
+	// New volumes always get the path-binding header by default; only
+	// volumes created by an older gocryptfs lack it.
+	cf.FeatureFlags = append(cf.FeatureFlags, FlagFilePathAAD)
+
+	masterkey := make([]byte, cryptocore.KeyLen)
+	if _, err := rand.Read(masterkey); err != nil {
+		return err
+	}
+	defer wipe(masterkey)
+
+	var kek []byte
+	var err error
+	switch kdf {
+	case "", kdfScrypt:
+		sp := ScryptParams{Salt: randBytes(scryptSaltLen), N: logN, R: 8, P: 1}
+		kek, err = scryptDeriveKey(password, sp)
+		cf.ScryptObject = sp
+		cf.KDF = &KDFConf{Algo: kdfScrypt, Scrypt: &sp}
+	case kdfArgon2id:
+		if argon2Params == nil {
+			return fmt.Errorf("configfile: argon2Params must be set when kdf=%q", kdfArgon2id)
+		}
+		ap := *argon2Params
+		ap.Algo = kdfArgon2id
+		ap.Salt = randBytes(16)
+		kek = argon2idDeriveKey(password, ap)
+		cf.KDF = &KDFConf{Algo: kdfArgon2id, Argon2: &ap}
+	default:
+		return fmt.Errorf("configfile: unknown kdf %q", kdf)
+	}
+	if err != nil {
+		return err
+	}
+	defer wipe(kek)
+
+	cc := cryptocore.New(kek, cryptocore.BackendGoGCM, cryptocore.DefaultIVBits)
+	cf.EncryptedKey = cc.EncryptBlock(masterkey, 0, nil)
+
+	return writeConfFile(filename, &cf)
+}
+
+// writeConfFile serializes "cf" to JSON and writes it to "filename",
+// via a temporary file that is renamed into place so a crash never leaves
+// behind a half-written config file.
+func writeConfFile(filename string, cf *ConfFile) error {
+	tmp := filename + ".tmp"
+	js, err := json.MarshalIndent(cf, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(tmp, js, 0400); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// loadConfFile loads and parses gocryptfs.conf and returns the derived
+// decryption key for the masterkey. For a PKCS#11-backed config it returns
+// the unwrapped masterkey itself instead.
+func loadConfFile(filename string, password []byte) (*ConfFile, []byte, error) {
+	js, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cf ConfFile
+	if err = json.Unmarshal(js, &cf); err != nil {
+		return nil, nil, err
+	}
+	cf.filename = filename
+
+	for _, flag := range cf.FeatureFlags {
+		if !isKnownFlag(flag) {
+			return nil, nil, fmt.Errorf("configfile: unknown feature flag %q, please update gocryptfs", flag)
+		}
+	}
+
+	if cf.PKCS11 != nil {
+		dek, err := pkcs11UnwrapMasterkey(cf.PKCS11.Module, cf.PKCS11.Slot, cf.PKCS11.Label, cf.PKCS11.WrappedKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The PKCS#11 path hands back the masterkey directly, not a KEK -
+		// the caller's decrypt-with-kek step is a no-op passthrough here.
+		return &cf, dek, nil
+	}
+
+	kdf := kdfScrypt
+	if cf.KDF != nil && cf.KDF.Algo != "" {
+		kdf = cf.KDF.Algo
+	}
+
+	var kek []byte
+	switch kdf {
+	case kdfScrypt:
+		sp := cf.ScryptObject
+		if cf.KDF != nil && cf.KDF.Scrypt != nil {
+			sp = *cf.KDF.Scrypt
+		}
+		kek, err = scryptDeriveKey(password, sp)
+	case kdfArgon2id:
+		if cf.KDF == nil || cf.KDF.Argon2 == nil {
+			return nil, nil, fmt.Errorf("configfile: KDF.Algo=%q but KDF.Argon2 is missing", kdfArgon2id)
+		}
+		kek = argon2idDeriveKey(password, *cf.KDF.Argon2)
+	default:
+		return nil, nil, fmt.Errorf("configfile: unknown kdf %q in %s", kdf, filename)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cf, kek, nil
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		tlog.Fatal.Printf("configfile: random read failed: %v", err)
+	}
+	return b
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,91 @@
+package configfile
+
+import (
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// kdfScrypt and kdfArgon2id are the values stored in ConfFile.KDF.Algo.
+// An empty Algo field means "scrypt" for backward compatibility with
+// config files written before this field existed.
+const (
+	kdfScrypt   = "scrypt"
+	kdfArgon2id = "argon2id"
+)
+
+// keyLen is the length, in bytes, of the key-wrapping key derived by
+// either KDF. It must equal cryptocore.KeyLen so the result can feed the
+// same key-unwrapping code regardless of which KDF produced it.
+const keyLen = cryptocore.KeyLen
+
+// Argon2Params stores the parameters of the Argon2id key derivation as
+// written to gocryptfs.conf's "KDF" section.
+type Argon2Params struct {
+	// Algo is always kdfArgon2id. It is redundant with KDFConf.Algo but
+	// makes the on-disk JSON self-describing even if KDFConf's shape
+	// changes later.
+	Algo string
+	// Time is the number of passes over memory (Argon2 "t").
+	Time uint32
+	// Memory is the amount of memory to use, in KiB (Argon2 "m").
+	Memory uint32
+	// Parallelism is the number of parallel threads (Argon2 "p").
+	Parallelism uint8
+	// Salt is the random salt used for this derivation.
+	Salt []byte
+}
+
+// KDFConf is the union of all supported key derivation function parameter
+// sets. Exactly one of Scrypt or Argon2 is populated, selected by Algo.
+// Old config files that predate this struct are parsed into the legacy
+// ScryptObject field on ConfFile instead and get Algo implicitly set to
+// kdfScrypt when loaded.
+type KDFConf struct {
+	Algo   string
+	Scrypt *ScryptParams `json:",omitempty"`
+	Argon2 *Argon2Params `json:",omitempty"`
+}
+
+// argon2idDeriveKey runs Argon2id on "password" using "p" and returns the
+// derived key. The salt in "p" must already be set.
+func argon2idDeriveKey(password []byte, p Argon2Params) []byte {
+	return argon2.IDKey(password, p.Salt, p.Time, p.Memory, p.Parallelism, keyLen)
+}
+
+// Argon2idKDFBenchmark picks Argon2id parameters that take approximately
+// "target" wall-clock time to run on this machine, the same way -scryptn
+// picks an N parameter. It keeps memory and parallelism fixed at
+// sane defaults (64 MiB, GOMAXPROCS lanes, capped at 8) and raises only
+// the number of passes, one at a time from 1, until a single derivation
+// takes at least "target", because passes scale linearly with time.
+func Argon2idKDFBenchmark(target time.Duration) Argon2Params {
+	p := Argon2Params{
+		Algo:        kdfArgon2id,
+		Memory:      64 * 1024,
+		Parallelism: uint8(runtime.GOMAXPROCS(0)),
+		Salt:        make([]byte, 16),
+	}
+	if p.Parallelism > 8 {
+		p.Parallelism = 8
+	}
+	dummyPassword := []byte("benchmark")
+	for t := uint32(1); ; t++ {
+		p.Time = t
+		start := time.Now()
+		argon2idDeriveKey(dummyPassword, p)
+		if time.Since(start) >= target {
+			return p
+		}
+	}
+}
+
+// scryptDeriveKey runs scrypt on "password" using "p" and returns the
+// derived key.
+func scryptDeriveKey(password []byte, p ScryptParams) ([]byte, error) {
+	return scrypt.Key(password, p.Salt, 1<<p.N, p.R, p.P, keyLen)
+}
@@ -0,0 +1,57 @@
+package configfile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// knownFlags are the feature flags this version of gocryptfs understands.
+// CreateConfFile only ever sets flags from this list, and loading a config
+// file that contains an unknown flag should be refused rather than
+// silently ignored.
+var knownFlags = []string{
+	"PlaintextNames",
+	"FilePathAAD",
+}
+
+// FlagFilePathAAD marks volumes whose files are opened with their path-id
+// (see nametransform.PathIV) mixed in as additional authenticated data on
+// every block (see fusefrontend.File.aad), so that swapping two
+// ciphertext files on disk makes both fail to decrypt instead of silently
+// decrypting under the wrong name. Volumes created before this flag
+// existed keep working unchanged, just without the extra binding.
+const FlagFilePathAAD = "FilePathAAD"
+
+// HasFlag reports whether "flag" is set in the config file's FeatureFlags.
+func (cf *ConfFile) HasFlag(flag string) bool {
+	for _, f := range cf.FeatureFlags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// PeekFlag reports whether "flag" is set in the FeatureFlags of the config
+// file at "filename", without needing the password - FeatureFlags are
+// stored in cleartext JSON alongside the wrapped masterkey.
+func PeekFlag(filename, flag string) (bool, error) {
+	js, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	var cf ConfFile
+	if err = json.Unmarshal(js, &cf); err != nil {
+		return false, err
+	}
+	return cf.HasFlag(flag), nil
+}
+
+func isKnownFlag(flag string) bool {
+	for _, f := range knownFlags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
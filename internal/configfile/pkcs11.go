@@ -0,0 +1,166 @@
+package configfile
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// PKCS11Conf is the KDF/EncryptedKey substitute used when the masterkey
+// is wrapped by a key held on a PKCS#11 token instead of being derived from
+// a password. It is stored in ConfFile.PKCS11 and is mutually exclusive
+// with KDF/ScryptObject.
+type PKCS11Conf struct {
+	// Module is the path to the PKCS#11 module (.so) to load, e.g.
+	// "/usr/lib/softhsm/libsofthsm2.so".
+	Module string
+	// Slot is the token slot ID to open.
+	Slot uint
+	// Label identifies the wrapping key object on the token (CKA_LABEL).
+	Label string
+	// WrappedKey is the masterkey after C_WrapKey with the token-resident
+	// key identified by Label. Unlike EncryptedKey, the KEK that produced
+	// this never exists outside the token.
+	WrappedKey []byte
+}
+
+// CreateConfFileWithPKCS11 is the PKCS#11 counterpart of CreateConfFile: the
+// masterkey is wrapped by the key object "label" on the token in "slot" of
+// "module", so no password is required at mount time and the KEK never
+// touches host memory outside the token.
+func CreateConfFileWithPKCS11(filename string, plaintextNames bool, module string, slot uint, label string, creator string) error {
+	cf := ConfFile{
+		Creator: creator,
+		Version: 2,
+	}
+	if plaintextNames {
+		cf.FeatureFlags = append(cf.FeatureFlags, "PlaintextNames")
+	}
+	cf.FeatureFlags = append(cf.FeatureFlags, FlagFilePathAAD)
+
+	masterkey := make([]byte, cryptocore.KeyLen)
+	if _, err := rand.Read(masterkey); err != nil {
+		return err
+	}
+	defer wipe(masterkey)
+
+	wrapped, err := pkcs11WrapKey(module, slot, label, masterkey)
+	if err != nil {
+		return fmt.Errorf("configfile: pkcs11 wrap failed: %w", err)
+	}
+	cf.PKCS11 = &PKCS11Conf{Module: module, Slot: slot, Label: label, WrappedKey: wrapped}
+
+	return writeConfFile(filename, &cf)
+}
+
+// pkcs11UnwrapMasterkey opens "module", opens a session on "slot", finds
+// the key object "label" and uses it to C_Unwrap "wrapped" back into the
+// plaintext masterkey. It does not call C_Login, so no PIN is asked for
+// and the key object must be usable from a session that is not logged in.
+func pkcs11UnwrapMasterkey(module string, slot uint, label string, wrapped []byte) ([]byte, error) {
+	p := pkcs11.New(module)
+	if p == nil {
+		return nil, fmt.Errorf("pkcs11: failed to load module %q", module)
+	}
+	if err := p.Initialize(); err != nil {
+		return nil, err
+	}
+	defer p.Destroy()
+	defer p.Finalize()
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	defer p.CloseSession(session)
+
+	key, err := findKeyByLabel(p, session, label)
+	if err != nil {
+		return nil, err
+	}
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP, nil)}
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, len(wrapped)-8),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+	unwrapped, err := p.UnwrapKey(session, mech, key, wrapped, tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	// The unwrapped object lives in the token; pull the raw value back out
+	// via C_GetAttributeValue so the masterkey can be used by the Go AEAD
+	// implementation. This requires CKA_EXTRACTABLE=true above - a token
+	// that enforces CKA_SENSITIVE on the wrapping key object itself would
+	// still refuse CKA_VALUE on *that* object, but the DEK we unwrap here
+	// is ours to extract.
+	attrs, err := p.GetAttributeValue(session, unwrapped, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attrs[0].Value, nil
+}
+
+func pkcs11WrapKey(module string, slot uint, label string, masterkey []byte) ([]byte, error) {
+	p := pkcs11.New(module)
+	if p == nil {
+		return nil, fmt.Errorf("pkcs11: failed to load module %q", module)
+	}
+	if err := p.Initialize(); err != nil {
+		return nil, err
+	}
+	defer p.Destroy()
+	defer p.Finalize()
+
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, err
+	}
+	defer p.CloseSession(session)
+
+	key, err := findKeyByLabel(p, session, label)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, masterkey),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+	obj, err := p.CreateObject(session, tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP, nil)}
+	return p.WrapKey(session, mech, key, obj)
+}
+
+func findKeyByLabel(p *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (pkcs11.ObjectHandle, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := p.FindObjectsInit(session, tmpl); err != nil {
+		return 0, err
+	}
+	defer p.FindObjectsFinal(session)
+	objs, _, err := p.FindObjects(session, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) == 0 {
+		return 0, fmt.Errorf("pkcs11: no key object with label %q found", label)
+	}
+	return objs[0], nil
+}
@@ -0,0 +1,101 @@
+package configfile
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// StartRekey generates a fresh masterkey, wraps it under "password" using
+// the same KDF parameters as the existing gocryptfs.conf at confPath, and
+// writes the result to newConfPath (not yet the active config). It
+// returns both the old masterkey (unwrapped from confPath) and the new
+// one, so the caller can re-encrypt file contents from one to the other.
+func StartRekey(confPath, newConfPath string, password []byte) (oldMasterkey, newMasterkey []byte, err error) {
+	oldCf, oldKek, err := loadConfFile(confPath, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(oldKek)
+	if oldCf.PKCS11 != nil {
+		// oldKek is the raw masterkey here (see decryptMasterkey), not a
+		// KEK - wrapping newMasterkey under it below would make EncryptedKey
+		// reachable with only the old masterkey, while PKCS11.WrappedKey
+		// would still point at the old one. Reloading would then unwrap the
+		// old masterkey from the token and silently ignore EncryptedKey,
+		// leaving the config and the rekeyed file contents out of sync.
+		// Re-wrapping through the token is not implemented, so refuse.
+		return nil, nil, fmt.Errorf("configfile: rekey of a PKCS#11-backed volume is not supported; mount it and copy the data to a new volume instead")
+	}
+	oldMasterkey, err = decryptMasterkey(oldCf, oldKek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newMasterkey = make([]byte, cryptocore.KeyLen)
+	if _, err = rand.Read(newMasterkey); err != nil {
+		return nil, nil, err
+	}
+
+	newCf := *oldCf
+	newCf.Creator = oldCf.Creator
+	if err = encryptMasterkeyInto(&newCf, oldKek, newMasterkey); err != nil {
+		return nil, nil, err
+	}
+	if err = writeConfFile(newConfPath, &newCf); err != nil {
+		return nil, nil, err
+	}
+	return oldMasterkey, newMasterkey, nil
+}
+
+// LoadMasterkeyPair resumes an in-progress rekey: it loads both the
+// original (still-active) config and the pending replacement written by
+// StartRekey, unwrapping the old and new masterkeys respectively.
+func LoadMasterkeyPair(confPath, newConfPath string, password []byte) (oldMasterkey, newMasterkey []byte, err error) {
+	oldCf, oldKek, err := loadConfFile(confPath, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(oldKek)
+	if oldCf.PKCS11 != nil {
+		// StartRekey refuses PKCS#11 volumes before a journal can exist, so
+		// this should be unreachable; kept as a defensive check.
+		return nil, nil, fmt.Errorf("configfile: rekey of a PKCS#11-backed volume is not supported")
+	}
+	oldMasterkey, err = decryptMasterkey(oldCf, oldKek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newCf, newKek, err := loadConfFile(newConfPath, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipe(newKek)
+	newMasterkey, err = decryptMasterkey(newCf, newKek)
+	if err != nil {
+		return nil, nil, err
+	}
+	return oldMasterkey, newMasterkey, nil
+}
+
+// decryptMasterkey unwraps cf.EncryptedKey using kek. For a PKCS#11-backed
+// config, loadConfFile already hands back the unwrapped masterkey itself
+// in the kek slot (see its PKCS11 branch), so there is nothing left to
+// decrypt here - return it as-is.
+func decryptMasterkey(cf *ConfFile, kek []byte) ([]byte, error) {
+	if cf.PKCS11 != nil {
+		return kek, nil
+	}
+	cc := cryptocore.New(kek, cryptocore.BackendGoGCM, cryptocore.DefaultIVBits)
+	return cc.DecryptBlock(cf.EncryptedKey, 0, nil)
+}
+
+// encryptMasterkeyInto wraps "masterkey" with "kek" and stores the result
+// in cf.EncryptedKey.
+func encryptMasterkeyInto(cf *ConfFile, kek []byte, masterkey []byte) error {
+	cc := cryptocore.New(kek, cryptocore.BackendGoGCM, cryptocore.DefaultIVBits)
+	cf.EncryptedKey = cc.EncryptBlock(masterkey, 0, nil)
+	return nil
+}
@@ -0,0 +1,142 @@
+// Package contentenc encrypts and decrypts file content block-by-block.
+//
+// Each file starts with a header (the file ID) followed by a sequence of
+// fixed-size plaintext blocks, each stored as its own AES-GCM-sealed
+// ciphertext block with a random 12-byte nonce prepended. The caller
+// supplies the additional authenticated data (AAD) for each block, which
+// is how a file's identity (and optionally its ciphertext path, see
+// nametransform.PathIV) gets bound into the content - see
+// internal/fusefrontend for how the normal read/write path derives it.
+package contentenc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// DefaultBS is the default plaintext block size, in bytes.
+const DefaultBS = 4096
+
+// headerIDLen is the length of the per-file ID stored in the file header.
+const headerIDLen = 16
+
+// nonceLen is the length of the random nonce stored in front of every
+// block's ciphertext.
+const nonceLen = 12
+
+// FileHeader is the per-file header stored at the start of every
+// ciphertext file.
+type FileHeader struct {
+	// ID uniquely identifies the file. It is generated once, when the
+	// file is created, and never changes - even across a rename.
+	ID []byte
+}
+
+// ContentEnc encrypts and decrypts file content with a fixed masterkey.
+type ContentEnc struct {
+	gcm      cipher.AEAD
+	plainBS  int
+	cipherBS int
+}
+
+// New sets up a ContentEnc that encrypts and decrypts with "key", using a
+// plaintext block size of "plainBS" bytes.
+func New(key []byte, plainBS int) *ContentEnc {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &ContentEnc{
+		gcm:      gcm,
+		plainBS:  plainBS,
+		cipherBS: nonceLen + plainBS + gcm.Overhead(),
+	}
+}
+
+// WriteHeader writes a new file header with file ID "id" to "w".
+func (be *ContentEnc) WriteHeader(w io.Writer, id []byte) error {
+	_, err := w.Write(id)
+	return err
+}
+
+// ReadHeader reads and returns the file header from "r".
+func (be *ContentEnc) ReadHeader(r io.Reader) (*FileHeader, error) {
+	id := make([]byte, headerIDLen)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, err
+	}
+	return &FileHeader{ID: id}, nil
+}
+
+// ReadBlock reads the next ciphertext block from the current position of
+// "r" and returns it undecrypted. "blockNo" is not used for positioning:
+// "r" must already be at the start of that block (0-indexed, counted
+// after the header).
+func (be *ContentEnc) ReadBlock(r io.Reader, blockNo uint64) ([]byte, error) {
+	buf := make([]byte, be.cipherBS)
+	n, err := io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF {
+		// The last block of a file is usually shorter than cipherBS.
+		err = nil
+	}
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	return buf[:n], err
+}
+
+// DecryptBlock authenticates and decrypts "ciphertext" (as returned by
+// ReadBlock), using "aad" as the additional authenticated data. "aad"
+// must be exactly what EncryptBlock/WriteBlock used for this same block,
+// or authentication fails - this is what makes the AAD a binding, not
+// just an extra parameter.
+func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, aad []byte) ([]byte, error) {
+	if len(ciphertext) < nonceLen {
+		return nil, errors.New("contentenc: ciphertext block too short")
+	}
+	nonce := ciphertext[:nonceLen]
+	sealed := ciphertext[nonceLen:]
+	return be.gcm.Open(nil, nonce, sealed, blockAAD(blockNo, aad))
+}
+
+// EncryptBlock encrypts "plaintext" into a ciphertext block with a fresh
+// random nonce, authenticating it with "aad".
+func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, aad []byte) ([]byte, error) {
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := be.gcm.Seal(nil, nonce, plaintext, blockAAD(blockNo, aad))
+	return append(nonce, sealed...), nil
+}
+
+// WriteBlock encrypts "plaintext" and writes it to "w" as block number
+// "blockNo", authenticated with "aad".
+func (be *ContentEnc) WriteBlock(w io.Writer, plaintext []byte, blockNo uint64, aad []byte) error {
+	ciphertext, err := be.EncryptBlock(plaintext, blockNo, aad)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(ciphertext)
+	return err
+}
+
+// blockAAD mixes the block number into "aad" so ciphertext blocks cannot
+// be reordered within a file without detection.
+func blockAAD(blockNo uint64, aad []byte) []byte {
+	out := make([]byte, 8+len(aad))
+	binary.BigEndian.PutUint64(out, blockNo)
+	copy(out[8:], aad)
+	return out
+}
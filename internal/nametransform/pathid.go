@@ -0,0 +1,26 @@
+package nametransform
+
+import "crypto/sha256"
+
+// DirIVFilename is the name of the per-directory file that holds the
+// directory's IV (see ReadDirIV). It is gocryptfs housekeeping, never a
+// file the user created, so callers that walk a cipherdir must skip it
+// rather than treat it as file content.
+const DirIVFilename = "gocryptfs.diriv"
+
+// PathIV computes the path-id used as AEAD additional data when the
+// FilePathAAD feature flag is set: it binds a file's ciphertext blocks to
+// the specific (parent dir-IV, encrypted basename) pair the file was
+// created under, so moving or swapping the ciphertext file to a different
+// name or directory - including renaming another file on top of it -
+// makes every block fail authentication instead of quietly decrypting
+// under the wrong identity.
+//
+// dirIV is the 16-byte IV of the parent directory (see ReadDirIV) and
+// cipherBasename is the file's encrypted (not plaintext) basename.
+func PathIV(dirIV []byte, cipherBasename string) []byte {
+	h := sha256.New()
+	h.Write(dirIV)
+	h.Write([]byte(cipherBasename))
+	return h.Sum(nil)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkRekeyNotInProgress refuses to proceed if a rekey is in progress on
+// cipherdir. It takes the same non-blocking flock acquireRekeyLock (see
+// rekey.go) takes for the duration of a "gocryptfs -rekey" run, so mount
+// and a running rekey can never have the volume open at the same time -
+// the ciphertext tree is a mix of old-key and new-key files until the
+// rekey finishes, and gocryptfs.conf itself isn't swapped in until the
+// very end. For the same reason it also refuses while the journal of an
+// interrupted rekey is still present. Mount's startup path must call this
+// before reading gocryptfs.conf, the same way rekey itself does before
+// starting.
+func checkRekeyNotInProgress(cipherdir string) error {
+	journalPath := filepath.Join(cipherdir, rekeyJournalName)
+	lock, err := acquireRekeyLock(journalPath)
+	if err != nil {
+		return fmt.Errorf("refusing to mount %s: a rekey is in progress (%v)", cipherdir, err)
+	}
+	lock.Close()
+	if _, err := os.Stat(journalPath); err == nil {
+		return fmt.Errorf("refusing to mount %s: an interrupted rekey has left %s behind, run -rekey again to finish it", cipherdir, journalPath)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCheckRekeyNotInProgress covers the mount-side half of the lock
+// acquireRekeyLock's doc comment describes: mount must be refused while a
+// rekey holds the journal lock, and allowed again once it is released.
+func TestCheckRekeyNotInProgress(t *testing.T) {
+	cipherdir, err := ioutil.TempDir("", "mount-rekey-lock-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cipherdir)
+
+	if err := checkRekeyNotInProgress(cipherdir); err != nil {
+		t.Fatalf("mount should be allowed before any rekey has started: %v", err)
+	}
+
+	journalPath := filepath.Join(cipherdir, rekeyJournalName)
+	lock, err := acquireRekeyLock(journalPath)
+	if err != nil {
+		t.Fatalf("failed to simulate a running rekey: %v", err)
+	}
+
+	if err := checkRekeyNotInProgress(cipherdir); err == nil {
+		t.Error("mount should have been refused while the rekey lock is held")
+	}
+
+	lock.Close()
+	if err := checkRekeyNotInProgress(cipherdir); err != nil {
+		t.Errorf("mount should be allowed once the rekey lock has been released: %v", err)
+	}
+}
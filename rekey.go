@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// rekeyJournalName is the journal gocryptfs keeps in cipherdir while a
+// rekey is in progress. Its presence also tells "mount" to refuse to open
+// the volume, since the ciphertext tree is a mix of old-key and new-key
+// files until the rekey finishes.
+const rekeyJournalName = "gocryptfs.rekey.journal"
+
+// rekeyJournal is the on-disk state of an in-progress rekey. It is
+// rewritten after every converted file so an interrupted rekey can resume
+// instead of starting over.
+type rekeyJournal struct {
+	// Done lists cipherdir-relative paths that have already been
+	// re-encrypted under NewConfig and must not be touched again.
+	Done []string
+	// NewConfig is the not-yet-active gocryptfs.conf, holding the new
+	// masterkey wrapped under the same password as the old one. It is only
+	// renamed over the real gocryptfs.conf once every file is converted.
+	NewConfig string
+}
+
+// acquireRekeyLock takes an exclusive, non-blocking flock on
+// "<cipherdir>/gocryptfs.rekey.journal.lock", the same way sqlite or dpkg
+// use a lock file to keep two instances from touching the same state at
+// once. A second "gocryptfs -rekey" on the same cipherdir fails this call
+// immediately (see TestRekeyRefusesConcurrentRekey), and mount's startup
+// path takes the same non-blocking flock via checkRekeyNotInProgress (see
+// mount.go), so a mount while a rekey is running fails the same way.
+func acquireRekeyLock(journalPath string) (*os.File, error) {
+	f, err := os.OpenFile(journalPath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// rekey re-encrypts every file in args.cipherdir under a freshly generated
+// masterkey, re-wraps that masterkey under the existing password, and
+// swaps it into gocryptfs.conf only once every file has been converted.
+// It can be interrupted and resumed: progress is tracked in a journal file
+// under cipherdir, and a concurrent mount is refused for as long as that
+// journal exists.
+func rekey(args *argContainer) {
+	journalPath := filepath.Join(args.cipherdir, rekeyJournalName)
+	lock, err := acquireRekeyLock(journalPath)
+	if err != nil {
+		tlog.Fatal.Printf("Could not lock %s, is a mount or another rekey already running? %v", journalPath, err)
+		os.Exit(ERREXIT_INIT)
+	}
+	defer lock.Close()
+
+	password := readpassword.Once(args.extpass)
+
+	journal, oldMasterkey, newMasterkey, err := loadOrStartRekey(args.config, journalPath, password)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(ERREXIT_INIT)
+	}
+	defer func() {
+		for _, k := range [][]byte{oldMasterkey, newMasterkey} {
+			for i := range k {
+				k[i] = 0
+			}
+		}
+	}()
+
+	done := make(map[string]bool, len(journal.Done))
+	for _, p := range journal.Done {
+		done[p] = true
+	}
+
+	oldEnc := contentenc.New(oldMasterkey, contentenc.DefaultBS)
+	newEnc := contentenc.New(newMasterkey, contentenc.DefaultBS)
+
+	// FeatureFlags are cleartext JSON, so this can be checked before the
+	// rename gives the new config its final name.
+	pathAAD, err := configfile.PeekFlag(journal.NewConfig, configfile.FlagFilePathAAD)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(ERREXIT_INIT)
+	}
+
+	newConfigRel, err := filepath.Rel(args.cipherdir, journal.NewConfig)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(ERREXIT_INIT)
+	}
+
+	err = filepath.Walk(args.cipherdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(args.cipherdir, path)
+		if err != nil {
+			return err
+		}
+		if isRekeyHousekeepingFile(rel, newConfigRel) {
+			return nil
+		}
+		if info.IsDir() || done[rel] {
+			return nil
+		}
+		var aad []byte
+		if pathAAD {
+			dirIV, err := nametransform.ReadDirIV(filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			aad = nametransform.PathIV(dirIV, filepath.Base(path))
+		}
+		if err := rekeyFile(path, oldEnc, newEnc, aad); err != nil {
+			return err
+		}
+		journal.Done = append(journal.Done, rel)
+		done[rel] = true
+		return writeRekeyJournal(journalPath, journal)
+	})
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(ERREXIT_INIT)
+	}
+
+	// Every file now holds content encrypted under the new key. The last
+	// step, renaming the new config over the old one, is atomic, so a
+	// crash right here still leaves a consistent volume either way.
+	if err = os.Rename(journal.NewConfig, args.config); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(ERREXIT_INIT)
+	}
+	os.Remove(journalPath)
+
+	tlog.Info.Printf(tlog.ColorGreen + "Rekey complete." + tlog.ColorReset)
+	os.Exit(0)
+}
+
+// loadOrStartRekey either resumes an existing journal (found at
+// journalPath) or starts a new rekey: it generates a new masterkey, wraps
+// it under "password" into a side-by-side config file, and writes the
+// initial (empty) journal.
+func loadOrStartRekey(confPath, journalPath string, password []byte) (*rekeyJournal, []byte, []byte, error) {
+	if js, err := ioutil.ReadFile(journalPath); err == nil {
+		var j rekeyJournal
+		if err := json.Unmarshal(js, &j); err != nil {
+			return nil, nil, nil, err
+		}
+		oldKey, newKey, err := configfile.LoadMasterkeyPair(confPath, j.NewConfig, password)
+		return &j, oldKey, newKey, err
+	}
+
+	newConfig := confPath + ".rekey-new"
+	oldKey, newKey, err := configfile.StartRekey(confPath, newConfig, password)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	j := &rekeyJournal{NewConfig: newConfig}
+	if err := writeRekeyJournal(journalPath, j); err != nil {
+		return nil, nil, nil, err
+	}
+	return j, oldKey, newKey, nil
+}
+
+// isRekeyHousekeepingFile reports whether "rel" (cipherdir-relative) is
+// part of gocryptfs's or the rekey machinery's own bookkeeping rather than
+// a file to convert: the journal and its lock, the not-yet-active config
+// ("newConfigRel"), the normal gocryptfs.conf and its .tmp sibling, the
+// per-directory IV file, and the per-file temporary files rekeyFile
+// creates while converting (gocryptfs.rekey.*).
+func isRekeyHousekeepingFile(rel, newConfigRel string) bool {
+	switch {
+	case rel == rekeyJournalName, rel == rekeyJournalName+".lock":
+		return true
+	case rel == newConfigRel:
+		return true
+	case rel == configfile.ConfDefaultName, rel == configfile.ConfDefaultName+".tmp":
+		return true
+	case filepath.Base(rel) == nametransform.DirIVFilename:
+		return true
+	case strings.HasPrefix(filepath.Base(rel), "gocryptfs.rekey."):
+		return true
+	}
+	return false
+}
+
+// writeRekeyJournal writes "j" to "path" via a temp file + rename, the same
+// way writeConfFile does, so a crash mid-write can never leave truncated or
+// invalid JSON for loadOrStartRekey to choke on when resuming.
+func writeRekeyJournal(path string, j *rekeyJournal) error {
+	tmp := path + ".tmp"
+	js, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(tmp, js, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// rekeyFile decrypts "path" block-by-block with oldEnc and re-encrypts it
+// with newEnc in place, so memory use stays proportional to one block
+// instead of the whole file. StartRekey copies the old config's
+// FeatureFlags verbatim (see internal/configfile/rekey.go), so the old and
+// new volumes agree on FlagFilePathAAD and share the same per-block AAD:
+// "pathAAD", if non-nil, is mixed in alongside the file ID on both the old
+// (decrypt) and new (encrypt) side.
+func rekeyFile(path string, oldEnc, newEnc *contentenc.ContentEnc, pathAAD []byte) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header, err := oldEnc.ReadHeader(f)
+	if err != nil {
+		return err
+	}
+	aad := header.ID
+	if pathAAD != nil {
+		aad = append(append([]byte{}, header.ID...), pathAAD...)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "gocryptfs.rekey.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := newEnc.WriteHeader(tmp, header.ID); err != nil {
+		return err
+	}
+	for blockNo := uint64(0); ; blockNo++ {
+		ciphertext, err := oldEnc.ReadBlock(f, blockNo)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		plaintext, err := oldEnc.DecryptBlock(ciphertext, blockNo, aad)
+		if err != nil {
+			return err
+		}
+		if err := newEnc.WriteBlock(tmp, plaintext, blockNo, aad); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}